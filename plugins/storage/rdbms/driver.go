@@ -0,0 +1,167 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/go-safeweb/safesql"
+	"github.com/google/go-safeweb/safesql/uncheckedconversions"
+)
+
+// trustedDynamicSQL promotes query text assembled at runtime to a
+// safesql.TrustedSQLString. safesql.New only accepts compile-time string
+// constants, which a driver-rebound or chunk-sized statement can never be,
+// so call sites that build their query text purely by concatenating and
+// rebinding this package's own literal constants (never caller- or
+// user-controlled data) use this instead, per the safesql package doc's
+// guidance for "a trusted runtime-only source that cannot be controlled by
+// a user".
+func trustedDynamicSQL(query string) safesql.TrustedSQLString {
+	return uncheckedconversions.TrustedSQLStringFromStringKnownToSatisfyTypeContract(query)
+}
+
+// Driver abstracts the SQL dialect differences between the RDBMS backends
+// supported by this plugin, so that the event-flushing code can build
+// multi-row statements without hard-coding a single backend's placeholder
+// style or parameter limits.
+type Driver interface {
+	// Name returns the driver name as registered with database/sql.
+	Name() string
+	// Rebind rewrites a query built with `?` placeholders into the
+	// placeholder style expected by this driver. MySQL and SQLite accept
+	// `?` natively and return the query unmodified; PostgreSQL requires
+	// `$1, $2, ...`.
+	Rebind(query string) string
+	// MaxBatchParams returns the maximum number of bound parameters a
+	// single statement may carry for this backend, used to chunk
+	// multi-row INSERTs so they stay under the driver's limit.
+	MaxBatchParams() int
+	// InsertIgnoreSuffix returns the clause to append to an INSERT
+	// statement so that a row violating the given conflict columns is
+	// silently skipped instead of erroring.
+	InsertIgnoreSuffix(conflictColumns string) string
+}
+
+// MySQLDriver targets a MySQL or MariaDB backend via go-sql-driver/mysql.
+type MySQLDriver struct{}
+
+// Name implements Driver.
+func (MySQLDriver) Name() string { return "mysql" }
+
+// Rebind implements Driver. MySQL uses `?` placeholders natively.
+func (MySQLDriver) Rebind(query string) string { return query }
+
+// MaxBatchParams implements Driver. MySQL's default max_prepared_stmt_count
+// does not bound parameter count directly, but we cap it at the same value
+// as Postgres to keep a single, predictable chunk size across backends.
+func (MySQLDriver) MaxBatchParams() int { return 65535 }
+
+// InsertIgnoreSuffix implements Driver using MySQL's upsert-to-noop idiom.
+func (MySQLDriver) InsertIgnoreSuffix(conflictColumns string) string {
+	return " on duplicate key update job_id = job_id"
+}
+
+// SQLiteDriver targets an in-process or file-backed SQLite database via
+// mattn/go-sqlite3.
+type SQLiteDriver struct{}
+
+// Name implements Driver.
+func (SQLiteDriver) Name() string { return "sqlite3" }
+
+// Rebind implements Driver. SQLite uses `?` placeholders natively.
+func (SQLiteDriver) Rebind(query string) string { return query }
+
+// MaxBatchParams implements Driver. SQLite rejects statements with more
+// than SQLITE_MAX_VARIABLE_NUMBER bound parameters, which defaults to 999.
+func (SQLiteDriver) MaxBatchParams() int { return 999 }
+
+// InsertIgnoreSuffix implements Driver using SQLite's ON CONFLICT clause.
+func (SQLiteDriver) InsertIgnoreSuffix(conflictColumns string) string {
+	return " on conflict (" + conflictColumns + ") do nothing"
+}
+
+// PostgreSQLDriver targets a PostgreSQL backend via lib/pq.
+type PostgreSQLDriver struct{}
+
+// Name implements Driver.
+func (PostgreSQLDriver) Name() string { return "postgres" }
+
+// Rebind implements Driver, rewriting each `?` in order into `$1`, `$2`, ...
+// It does not attempt to parse the query, so it assumes (as the rest of
+// this package does) that `?` never appears outside of a placeholder
+// position, e.g. inside a quoted string literal.
+func (PostgreSQLDriver) Rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// MaxBatchParams implements Driver. PostgreSQL rejects statements with more
+// than 65535 bound parameters.
+func (PostgreSQLDriver) MaxBatchParams() int { return 65535 }
+
+// InsertIgnoreSuffix implements Driver using PostgreSQL's ON CONFLICT clause.
+func (PostgreSQLDriver) InsertIgnoreSuffix(conflictColumns string) string {
+	return " on conflict (" + conflictColumns + ") do nothing"
+}
+
+// chunkRows splits rows into groups whose parameter count (len(row) *
+// number of rows in the group) stays within maxParams, preserving row
+// order. It panics if a single row alone exceeds maxParams, which would
+// indicate a misconfigured driver rather than a runtime condition callers
+// should recover from.
+func chunkRows(rows [][]interface{}, maxParams int) [][][]interface{} {
+	if len(rows) == 0 {
+		return nil
+	}
+	fieldsPerRow := len(rows[0])
+	if fieldsPerRow > maxParams {
+		panic("rdbms: single row parameter count exceeds driver's MaxBatchParams")
+	}
+	rowsPerChunk := maxParams / fieldsPerRow
+	if rowsPerChunk == 0 {
+		rowsPerChunk = 1
+	}
+	var chunks [][][]interface{}
+	for len(rows) > 0 {
+		n := rowsPerChunk
+		if n > len(rows) {
+			n = len(rows)
+		}
+		chunks = append(chunks, rows[:n])
+		rows = rows[n:]
+	}
+	return chunks
+}
+
+// buildMultiRowInsert renders `prefix values (?, ?, ...), (?, ?, ...), ...`
+// for the given number of rows and fields per row, then rebinds the `?`
+// placeholders to the driver's native style.
+func buildMultiRowInsert(driver Driver, prefix string, fieldsPerRow, numRows int) safesql.TrustedSQLString {
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(" values ")
+	rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", fieldsPerRow), ", ") + ")"
+	for i := 0; i < numRows; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(rowPlaceholder)
+	}
+	return trustedDynamicSQL(driver.Rebind(b.String()))
+}
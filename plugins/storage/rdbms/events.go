@@ -9,8 +9,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
-	"github.com/linuxboot/contest/pkg/event"
 	"github.com/linuxboot/contest/pkg/event/frameworkevent"
 	"github.com/linuxboot/contest/pkg/event/testevent"
 	"github.com/linuxboot/contest/pkg/job"
@@ -21,101 +21,6 @@ import (
 	"github.com/google/go-safeweb/safesql"
 )
 
-func assembleQuery(baseQuery safesql.TrustedSQLString, selectClauses []safesql.TrustedSQLString) (safesql.TrustedSQLString, error) {
-	if len(selectClauses) == 0 {
-		return safesql.New(""), fmt.Errorf("no select clauses available, the query should specify at least one clause")
-	}
-	initialClause := true
-	for _, clause := range selectClauses {
-		if initialClause {
-			baseQuery = safesql.TrustedSQLStringConcat(baseQuery, safesql.New(" where "), clause)
-			initialClause = false
-		} else {
-			baseQuery = safesql.TrustedSQLStringConcat(baseQuery, safesql.New(" and "), clause)
-		}
-	}
-	return baseQuery, nil
-}
-
-func buildEventQuery(baseQuery safesql.TrustedSQLString, eventQuery *event.Query) ([]safesql.TrustedSQLString, []interface{}) {
-	selectClauses := []safesql.TrustedSQLString{}
-	fields := []interface{}{}
-
-	if eventQuery != nil && eventQuery.JobID != 0 {
-		selectClauses = append(selectClauses, safesql.New("job_id=?"))
-		fields = append(fields, eventQuery.JobID)
-	}
-
-	if eventQuery != nil && len(eventQuery.EventNames) != 0 {
-		if len(eventQuery.EventNames) == 1 {
-			selectClauses = append(selectClauses, safesql.New("event_name=?"))
-		} else {
-			var queryStr safesql.TrustedSQLString
-			queryStr = safesql.New("event_name in")
-			for i := 0; i < len(eventQuery.EventNames); i++ {
-				if i == 0 {
-					queryStr = safesql.TrustedSQLStringConcat(queryStr, safesql.New(" (?"))
-				} else if i < len(eventQuery.EventNames)-1 {
-					queryStr = safesql.TrustedSQLStringConcat(queryStr, safesql.New(", ?"))
-				} else {
-					queryStr = safesql.TrustedSQLStringConcat(queryStr, safesql.New(", ?)"))
-				}
-			}
-			selectClauses = append(selectClauses, queryStr)
-		}
-		for i := 0; i < len(eventQuery.EventNames); i++ {
-			fields = append(fields, eventQuery.EventNames[i])
-		}
-	}
-	if eventQuery != nil && !eventQuery.EmittedStartTime.IsZero() {
-		selectClauses = append(selectClauses, safesql.New("emit_time>=?"))
-		fields = append(fields, eventQuery.EmittedStartTime)
-	}
-	if eventQuery != nil && !eventQuery.EmittedEndTime.IsZero() {
-		selectClauses = append(selectClauses, safesql.New("emit_time<=?"))
-		fields = append(fields, eventQuery.EmittedStartTime)
-	}
-	return selectClauses, fields
-}
-
-func buildFrameworkEventQuery(baseQuery safesql.TrustedSQLString, frameworkEventQuery *frameworkevent.Query) (safesql.TrustedSQLString, []interface{}, error) {
-	selectClauses, fields := buildEventQuery(baseQuery, &frameworkEventQuery.Query)
-	query, err := assembleQuery(baseQuery, selectClauses)
-	if err != nil {
-		return safesql.New(""), nil, fmt.Errorf("could not assemble query for framework events: %v", err)
-
-	}
-	return query, fields, nil
-}
-
-func buildTestEventQuery(baseQuery safesql.TrustedSQLString, testEventQuery *testevent.Query) (safesql.TrustedSQLString, []interface{}, error) {
-
-	if testEventQuery == nil {
-		return safesql.New(""), nil, fmt.Errorf("cannot build empty testevent query")
-	}
-	selectClauses, fields := buildEventQuery(baseQuery, &testEventQuery.Query)
-
-	if testEventQuery.RunID != types.RunID(0) {
-		selectClauses = append(selectClauses, safesql.New("run_id=?"))
-		fields = append(fields, testEventQuery.RunID)
-	}
-
-	if testEventQuery.TestName != "" {
-		selectClauses = append(selectClauses, safesql.New("test_name=?"))
-		fields = append(fields, testEventQuery.TestName)
-	}
-	if testEventQuery.TestStepLabel != "" {
-		selectClauses = append(selectClauses, safesql.New("test_step_label=?"))
-		fields = append(fields, testEventQuery.TestStepLabel)
-	}
-	query, err := assembleQuery(baseQuery, selectClauses)
-	if err != nil {
-		return safesql.New(""), nil, fmt.Errorf("could not assemble query for framework events: %v", err)
-
-	}
-	return query, fields, nil
-}
-
 // TestEventField is a function type which retrieves information from a TestEvent object.
 type TestEventField func(ev testevent.Event) interface{}
 
@@ -202,17 +107,32 @@ func (r *RDBMS) StoreTestEvent(_ xcontext.Context, event testevent.Event) error
 	return nil
 }
 
+const insertTestEventPrefix = "insert into test_events (job_id, run_id, test_name, test_attempt, test_step_label, event_name, target_id, payload, emit_time)"
+
+// testEventFields is the number of `?` placeholders a single test_events
+// row occupies in the insert statement above; it must stay in sync with
+// insertTestEventPrefix.
+const testEventFields = 9
+
 // flushTestEventsLocked forces a flush of the pending test events to the database.
 // Requires that the caller has already locked the corresponding buffer.
+//
+// Events are inserted in chunks of multi-row statements, sized so that no
+// chunk exceeds the driver's parameter limit, and all chunks are wrapped in
+// a single transaction so a failure partway through never leaves the
+// buffer's events only partially persisted.
 func (r *RDBMS) flushTestEventsLocked() error {
 
 	r.lockTx()
 	defer r.unlockTx()
 
-	insertStatement := safesql.New("insert into test_events (job_id, run_id, test_name, test_attempt, test_step_label, event_name, target_id, payload, emit_time) values (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if len(r.buffTestEvents) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, 0, len(r.buffTestEvents))
 	for _, event := range r.buffTestEvents {
-		_, err := r.db.Exec(
-			insertStatement,
+		rows = append(rows, []interface{}{
 			TestEventJobID(event),
 			TestEventRunID(event),
 			TestEventTestName(event),
@@ -221,10 +141,31 @@ func (r *RDBMS) flushTestEventsLocked() error {
 			TestEventName(event),
 			TestEventTargetID(event),
 			TestEventPayload(event),
-			TestEventEmitTime(event))
-		if err != nil {
-			return fmt.Errorf("could not store event in database: %v", err)
+			TestEventEmitTime(event),
+		})
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction to store test events: %v", err)
+	}
+	for _, chunk := range chunkRows(rows, r.driver.MaxBatchParams()) {
+		insertStatement := buildMultiRowInsert(r.driver, insertTestEventPrefix, testEventFields, len(chunk))
+		fields := make([]interface{}, 0, len(chunk)*testEventFields)
+		for _, row := range chunk {
+			fields = append(fields, row...)
 		}
+		if _, err := tx.Exec(insertStatement, fields...); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("could not store test events in database: %v", err)
+		}
+	}
+	if err := r.foldTestEventRunHistoryLocked(tx, rows); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit test events transaction: %v", err)
 	}
 	r.buffTestEvents = nil
 
@@ -251,12 +192,12 @@ func (r *RDBMS) GetTestEvents(ctx xcontext.Context, eventQuery *testevent.Query)
 	r.lockTx()
 	defer r.unlockTx()
 
-	const baseQuery = "select event_id, job_id, run_id, test_name, test_attempt, test_step_label, event_name, target_id, payload, emit_time from test_events"
-	query, fields, err := buildTestEventQuery(safesql.New(baseQuery), eventQuery)
+	query, fields, err := buildTestEventQuery(r.driver, testEventsBaseQuery, eventQuery)
 	if err != nil {
 		return nil, fmt.Errorf("could not execute select query for test events: %v", err)
 	}
 
+	// Not cached: see preparedStatementCache's doc comment.
 	var results []testevent.Event
 	ctx.Debugf("Executing query: %s, fields: %v", query, fields)
 	rows, err := r.db.Query(query, fields...)
@@ -264,12 +205,6 @@ func (r *RDBMS) GetTestEvents(ctx xcontext.Context, eventQuery *testevent.Query)
 		return nil, err
 	}
 
-	// TargetID might be null, so a type which supports null should be used with Scan
-	var (
-		targetID sql.NullString
-		payload  sql.NullString
-	)
-
 	defer func() {
 		err := rows.Close()
 		if err != nil {
@@ -277,42 +212,59 @@ func (r *RDBMS) GetTestEvents(ctx xcontext.Context, eventQuery *testevent.Query)
 		}
 	}()
 	for rows.Next() {
-		data := testevent.Data{}
-		header := testevent.Header{}
-		event := testevent.New(&header, &data)
-
-		var eventID int
-		err := rows.Scan(
-			&eventID,
-			&header.JobID,
-			&header.RunID,
-			&header.TestName,
-			&header.TestAttempt,
-			&header.TestStepLabel,
-			&data.EventName,
-			&targetID,
-			&payload,
-			&event.EmitTime,
-		)
+		event, _, err := scanTestEventRow(rows)
 		if err != nil {
-			return nil, fmt.Errorf("could not read results from db: %v", err)
-		}
-		if targetID.Valid {
-			t := target.Target{ID: targetID.String}
-			data.Target = &t
-		}
-
-		if payload.Valid {
-			rawPayload := json.RawMessage(payload.String)
-			data.Payload = &rawPayload
-
+			return nil, err
 		}
-
+		rowsScannedTotal.Inc()
+		bytesReturnedTotal.Add(float64(eventSize(event)))
 		results = append(results, event)
 	}
 	return results, nil
 }
 
+// scanTestEventRow scans a single row of a `select event_id, job_id, run_id,
+// test_name, test_attempt, test_step_label, event_name, target_id, payload,
+// emit_time from test_events` query into a testevent.Event, also returning
+// its event_id so cursor-based callers can resume from it.
+func scanTestEventRow(rows *sql.Rows) (testevent.Event, int64, error) {
+	data := testevent.Data{}
+	header := testevent.Header{}
+	event := testevent.New(&header, &data)
+
+	// TargetID and payload might be null, so a type which supports null
+	// should be used with Scan.
+	var (
+		eventID  int64
+		targetID sql.NullString
+		payload  sql.NullString
+	)
+	err := rows.Scan(
+		&eventID,
+		&header.JobID,
+		&header.RunID,
+		&header.TestName,
+		&header.TestAttempt,
+		&header.TestStepLabel,
+		&data.EventName,
+		&targetID,
+		&payload,
+		&event.EmitTime,
+	)
+	if err != nil {
+		return testevent.Event{}, 0, fmt.Errorf("could not read results from db: %v", err)
+	}
+	if targetID.Valid {
+		t := target.Target{ID: targetID.String}
+		data.Target = &t
+	}
+	if payload.Valid {
+		rawPayload := json.RawMessage(payload.String)
+		data.Payload = &rawPayload
+	}
+	return event, eventID, nil
+}
+
 // FrameworkEventField is a function type which retrieves information from a FrameworkEvent object
 type FrameworkEventField func(ev frameworkevent.Event) interface{}
 
@@ -352,36 +304,81 @@ func (r *RDBMS) StoreFrameworkEvent(ctx xcontext.Context, event frameworkevent.E
 }
 
 const (
-	insertFEStmt       = "INSERT INTO framework_events (job_id, event_name, payload, emit_time) VALUES (?, ?, ?, ?)"
+	insertFEPrefix     = "INSERT INTO framework_events (job_id, event_name, payload, emit_time)"
 	updateJobStateStmt = "UPDATE jobs SET state = ? WHERE job_id = ?"
 )
 
+// frameworkEventFields is the number of `?` placeholders a single
+// framework_events row occupies; it must stay in sync with insertFEPrefix.
+const frameworkEventFields = 4
+
 // flushFrameworkEventsLocked forces a flush of the pending frameworks events to the database
 // Requires that the caller has already locked the corresponding buffer.
+//
+// The event inserts and the derived job-state updates are wrapped in a
+// single transaction, so a failure partway through never leaves a job's
+// state out of sync with the events that drove it there.
 func (r *RDBMS) flushFrameworkEventsLocked() error {
 	r.lockTx()
 	defer r.unlockTx()
 
-	// TODO: put this into a transaction.
+	if len(r.buffFrameworkEvents) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, 0, len(r.buffFrameworkEvents))
 	jobStateUpdates := map[types.JobID]job.State{}
+	jobEndTime := map[types.JobID]time.Time{}
+	jobPayload := map[types.JobID]*json.RawMessage{}
 	for _, event := range r.buffFrameworkEvents {
-		_, err := r.db.Exec(
-			safesql.New(insertFEStmt),
+		rows = append(rows, []interface{}{
 			FrameworkEventJobID(event),
 			FrameworkEventName(event),
 			FrameworkEventPayload(event),
-			FrameworkEventEmitTime(event))
-		if err != nil {
-			return fmt.Errorf("could not store event in database: %v", err)
-		}
+			FrameworkEventEmitTime(event),
+		})
 		if sn, err := job.EventNameToJobState(event.EventName); err == nil {
 			jobStateUpdates[event.JobID] = sn
+			jobEndTime[event.JobID] = event.EmitTime
+			jobPayload[event.JobID] = event.Payload
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction to store framework events: %v", err)
+	}
+	for _, chunk := range chunkRows(rows, r.driver.MaxBatchParams()) {
+		insertStatement := buildMultiRowInsert(r.driver, insertFEPrefix, frameworkEventFields, len(chunk))
+		fields := make([]interface{}, 0, len(chunk)*frameworkEventFields)
+		for _, row := range chunk {
+			fields = append(fields, row...)
+		}
+		if _, err := tx.Exec(insertStatement, fields...); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("could not store framework events in database: %v", err)
 		}
 	}
-	for jobID, state := range jobStateUpdates {
-		if _, err := r.db.Exec(safesql.New(updateJobStateStmt), state, jobID); err != nil {
-			return fmt.Errorf("could not update state of job %d: %w", jobID, err)
+	var updateStmt safesql.TrustedSQLString = trustedDynamicSQL(r.driver.Rebind(updateJobStateStmt))
+	err = r.withPreparedStatement(updateStmt, func(stmt *sql.Stmt) error {
+		txStmt := tx.Stmt(stmt)
+		for jobID, state := range jobStateUpdates {
+			if _, err := txStmt.Exec(state, jobID); err != nil {
+				return fmt.Errorf("could not update state of job %d: %w", jobID, err)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := r.foldFrameworkEventRunHistoryLocked(tx, jobStateUpdates, jobEndTime, jobPayload); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit framework events transaction: %v", err)
 	}
 	r.buffFrameworkEvents = nil
 	return nil
@@ -406,11 +403,12 @@ func (r *RDBMS) GetFrameworkEvent(ctx xcontext.Context, eventQuery *frameworkeve
 	r.lockTx()
 	defer r.unlockTx()
 
-	baseQuery := safesql.New("select event_id, job_id, event_name, payload, emit_time from framework_events")
-	query, fields, err := buildFrameworkEventQuery(baseQuery, eventQuery)
+	const baseQuery = "select event_id, job_id, event_name, payload, emit_time from framework_events"
+	query, fields, err := buildFrameworkEventQuery(r.driver, baseQuery, eventQuery)
 	if err != nil {
 		return nil, fmt.Errorf("could not execute select query for test events: %v", err)
 	}
+	// Not cached: see preparedStatementCache's doc comment.
 	results := []frameworkevent.Event{}
 	ctx.Debugf("Executing query: %s, fields: %v", query, fields)
 	rows, err := r.db.Query(query, fields...)
@@ -0,0 +1,49 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"github.com/linuxboot/contest/pkg/event/testevent"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rowsScannedTotal and bytesReturnedTotal give operators visibility into
+// how much data test-event reads are pulling out of the database, so a
+// query that regresses into scanning far more than it returns (or a client
+// that never bounds its result set) shows up in existing dashboards rather
+// than as a surprise OOM.
+var (
+	rowsScannedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "contest",
+		Subsystem: "rdbms",
+		Name:      "test_events_rows_scanned_total",
+		Help:      "Total number of test_events rows scanned by GetTestEvents, StreamTestEvents and GetTestEventsPage.",
+	})
+
+	bytesReturnedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "contest",
+		Subsystem: "rdbms",
+		Name:      "test_events_bytes_returned_total",
+		Help:      "Total size, in bytes, of the payloads returned by GetTestEvents, StreamTestEvents and GetTestEventsPage.",
+	})
+)
+
+// eventSize estimates the wire size of a test event's variable-length
+// fields, for the bytesReturnedTotal counter. It intentionally only counts
+// the payload and the fields most likely to dominate size; it is a metric,
+// not an accounting figure.
+func eventSize(ev testevent.Event) int {
+	size := len(ev.Header.TestName) + len(ev.Header.TestStepLabel)
+	if ev.Data != nil {
+		size += len(ev.Data.EventName)
+		if ev.Data.Payload != nil {
+			size += len(*ev.Data.Payload)
+		}
+	}
+	return size
+}
@@ -0,0 +1,144 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+
+	"github.com/google/go-safeweb/safesql"
+)
+
+// defaultStatementCacheSize is the number of prepared statements kept
+// around when WithStatementCacheSize is not supplied to NewRDBMS.
+const defaultStatementCacheSize = 128
+
+// preparedStatementCache caches *sql.Stmt by the trusted SQL text that
+// produced it, evicting the least recently used entry once it grows past
+// its capacity. It only ever sees a handful of distinct statements, since
+// it's deliberately restricted to the fixed-text statements this package
+// executes unchanged on every flush: the job-state update, the run-history
+// start insert and the run-history close-out update. It is NOT used for
+// the multi-row batch inserts in flushTestEventsLocked/
+// flushFrameworkEventsLocked (text varies with chunk size) nor for the
+// filtered/paginated select queries built by assembleQuery (text varies
+// with which predicates the caller set and how many values an `in (...)`
+// clause expands to) -- caching either would thrash on every distinct
+// shape instead of ever getting a hit. Call sites of those reads point
+// back here ("Not cached: see preparedStatementCache's doc comment")
+// rather than repeating this rationale.
+//
+// A capacity of 0 disables the cache: prepare neither stores nor reuses
+// anything, so every call prepares a fresh statement that the caller is
+// expected to close once done with it (see withPreparedStatement).
+type preparedStatementCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type preparedStatementEntry struct {
+	key  string
+	stmt *sql.Stmt
+}
+
+func newPreparedStatementCache(capacity int) *preparedStatementCache {
+	return &preparedStatementCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+// prepare returns a *sql.Stmt for query, preparing one via prepareFn if
+// this is the first time query has been seen (or it was since evicted),
+// and reports whether the returned statement is owned by the cache. When
+// it isn't (the cache is disabled), the caller is responsible for closing
+// the statement once done with it.
+func (c *preparedStatementCache) prepare(query safesql.TrustedSQLString, prepareFn func(safesql.TrustedSQLString) (*sql.Stmt, error)) (stmt *sql.Stmt, cached bool, err error) {
+	if c.capacity <= 0 {
+		stmt, err = prepareFn(query)
+		return stmt, false, err
+	}
+
+	key := query.String()
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		stmt := elem.Value.(*preparedStatementEntry).stmt
+		c.mu.Unlock()
+		return stmt, true, nil
+	}
+	c.mu.Unlock()
+
+	stmt, err = prepareFn(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another goroutine may have raced us to prepare the same statement;
+	// keep whichever is already cached and close the redundant one.
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		cached := elem.Value.(*preparedStatementEntry).stmt
+		_ = stmt.Close()
+		return cached, true, nil
+	}
+	elem := c.ll.PushFront(&preparedStatementEntry{key: key, stmt: stmt})
+	c.items[key] = elem
+	if c.ll.Len() > c.capacity {
+		c.evictOldestLocked()
+	}
+	return stmt, true, nil
+}
+
+// evictOldestLocked drops the least recently used statement. Callers must
+// hold c.mu.
+func (c *preparedStatementCache) evictOldestLocked() {
+	elem := c.ll.Back()
+	if elem == nil {
+		return
+	}
+	c.ll.Remove(elem)
+	entry := elem.Value.(*preparedStatementEntry)
+	delete(c.items, entry.key)
+	_ = entry.stmt.Close()
+}
+
+// withPreparedStatement prepares (or reuses a cached preparation of) query
+// and passes it to fn. If the statement cache is disabled
+// (WithStatementCacheSize(0)), the freshly prepared statement is closed
+// once fn returns instead of leaking one *sql.Stmt per call.
+func (r *RDBMS) withPreparedStatement(query safesql.TrustedSQLString, fn func(*sql.Stmt) error) error {
+	stmt, cached, err := r.stmtCache.prepare(query, r.db.Prepare)
+	if err != nil {
+		return err
+	}
+	if !cached {
+		defer stmt.Close()
+	}
+	return fn(stmt)
+}
+
+// Close closes every statement currently cached.
+func (c *preparedStatementCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var firstErr error
+	for _, elem := range c.items {
+		if err := elem.Value.(*preparedStatementEntry).stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.ll = list.New()
+	c.items = make(map[string]*list.Element, c.capacity)
+	return firstErr
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build integration
+
+package rdbms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/event/frameworkevent"
+	"github.com/linuxboot/contest/pkg/types"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+)
+
+// BenchmarkFlushFrameworkEventsCached and BenchmarkFlushFrameworkEventsUncached
+// flush one framework event (and its derived job-state update) at a time
+// against an in-process SQLite database, with the prepared-statement cache
+// enabled and disabled respectively. The job-state update is the statement
+// WithStatementCacheSize exists to avoid re-preparing on every flush.
+//
+//	go test -tags=integration -bench=FlushFrameworkEvents -benchtime=2000x ./plugins/storage/rdbms/...
+func BenchmarkFlushFrameworkEventsCached(b *testing.B) {
+	benchmarkFlushFrameworkEvents(b, defaultStatementCacheSize)
+}
+
+func BenchmarkFlushFrameworkEventsUncached(b *testing.B) {
+	benchmarkFlushFrameworkEvents(b, 0)
+}
+
+func benchmarkFlushFrameworkEvents(b *testing.B, statementCacheSize int) {
+	db, err := safesql.Open("sqlite3", "file::memory:?cache=shared")
+	if err != nil {
+		b.Fatalf("could not open sqlite3: %v", err)
+	}
+	defer db.Close()
+
+	for _, stmt := range schemaByDriver["sqlite3"] {
+		if _, err := db.Exec(trustedDynamicSQL(stmt)); err != nil {
+			b.Fatalf("could not create schema: %v", err)
+		}
+	}
+
+	r, err := NewRDBMS(&db, WithDriver(SQLiteDriver{}), WithFrameworkEventsFlushSize(1), WithStatementCacheSize(statementCacheSize))
+	if err != nil {
+		b.Fatalf("NewRDBMS: %v", err)
+	}
+	defer r.Close()
+
+	ctx := xcontext.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ev := frameworkevent.Event{
+			JobID:     types.JobID(1),
+			EventName: "JobStateStarted",
+			EmitTime:  time.Now(),
+		}
+		if err := r.StoreFrameworkEvent(ctx, ev); err != nil {
+			b.Fatalf("StoreFrameworkEvent: %v", err)
+		}
+	}
+}
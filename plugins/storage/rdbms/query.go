@@ -0,0 +1,140 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/event"
+	"github.com/linuxboot/contest/pkg/event/frameworkevent"
+	"github.com/linuxboot/contest/pkg/event/testevent"
+	"github.com/linuxboot/contest/pkg/types"
+
+	"github.com/google/go-safeweb/safesql"
+	"github.com/jmoiron/sqlx"
+)
+
+// eventFilter mirrors the predicates on event.Query as named-parameter
+// fields, so they can be bound with sqlx.Named instead of a hand-spliced
+// `?` placeholder loop.
+type eventFilter struct {
+	JobID            types.JobID `db:"job_id"`
+	EventNames       []string    `db:"event_names"`
+	EmittedStartTime time.Time   `db:"emitted_start_time"`
+	EmittedEndTime   time.Time   `db:"emitted_end_time"`
+}
+
+// testEventFilter extends eventFilter with the predicates specific to
+// testevent.Query.
+type testEventFilter struct {
+	eventFilter
+	RunID         types.RunID `db:"run_id"`
+	TestName      string      `db:"test_name"`
+	TestStepLabel string      `db:"test_step_label"`
+}
+
+// buildEventQuery returns the named where-clauses that apply to eventQuery
+// and the filter struct sqlx.Named will bind them against. Clauses are only
+// included for predicates the caller actually set, mirroring the
+// conditional assembly the old `?`-splicing code did by hand.
+func buildEventQuery(eventQuery *event.Query) ([]string, eventFilter) {
+	clauses := []string{}
+	var filter eventFilter
+	if eventQuery == nil {
+		return clauses, filter
+	}
+
+	if eventQuery.JobID != 0 {
+		clauses = append(clauses, "job_id = :job_id")
+		filter.JobID = eventQuery.JobID
+	}
+	if len(eventQuery.EventNames) != 0 {
+		clauses = append(clauses, "event_name in (:event_names)")
+		eventNames := make([]string, len(eventQuery.EventNames))
+		for i, name := range eventQuery.EventNames {
+			eventNames[i] = string(name)
+		}
+		filter.EventNames = eventNames
+	}
+	if !eventQuery.EmittedStartTime.IsZero() {
+		clauses = append(clauses, "emit_time >= :emitted_start_time")
+		filter.EmittedStartTime = eventQuery.EmittedStartTime
+	}
+	if !eventQuery.EmittedEndTime.IsZero() {
+		clauses = append(clauses, "emit_time <= :emitted_end_time")
+		filter.EmittedEndTime = eventQuery.EmittedEndTime
+	}
+	return clauses, filter
+}
+
+// assembleQuery joins baseQuery with the given named where-clauses and an
+// optional raw suffix (e.g. an ORDER BY/LIMIT tail), then binds the whole
+// thing against filter via sqlx.Named and sqlx.In, expanding any
+// `in (:slice)` clauses and rebinding the result to the driver's native
+// placeholder style. It returns a safesql.TrustedSQLString because the
+// final query text is derived entirely from the literal baseQuery, clause
+// and suffix strings compiled into this package: no caller-controlled text
+// ever reaches the query itself, only bound parameter values.
+func assembleQuery(driver Driver, baseQuery string, clauses []string, suffix string, filter interface{}) (safesql.TrustedSQLString, []interface{}, error) {
+	if len(clauses) == 0 {
+		return safesql.New(""), nil, fmt.Errorf("no select clauses available, the query should specify at least one clause")
+	}
+	query := baseQuery + " where " + strings.Join(clauses, " and ") + suffix
+
+	named, namedArgs, err := sqlx.Named(query, filter)
+	if err != nil {
+		return safesql.New(""), nil, fmt.Errorf("could not bind named query parameters: %w", err)
+	}
+	in, inArgs, err := sqlx.In(named, namedArgs...)
+	if err != nil {
+		return safesql.New(""), nil, fmt.Errorf("could not expand in-clause parameters: %w", err)
+	}
+	return trustedDynamicSQL(driver.Rebind(in)), inArgs, nil
+}
+
+func buildFrameworkEventQuery(driver Driver, baseQuery string, frameworkEventQuery *frameworkevent.Query) (safesql.TrustedSQLString, []interface{}, error) {
+	clauses, filter := buildEventQuery(&frameworkEventQuery.Query)
+	query, fields, err := assembleQuery(driver, baseQuery, clauses, "", filter)
+	if err != nil {
+		return safesql.New(""), nil, fmt.Errorf("could not assemble query for framework events: %w", err)
+	}
+	return query, fields, nil
+}
+
+// testEventClauses builds the named where-clauses and bind filter shared by
+// buildTestEventQuery and buildTestEventQueryPage.
+func testEventClauses(testEventQuery *testevent.Query) ([]string, testEventFilter) {
+	clauses, eventFilter := buildEventQuery(&testEventQuery.Query)
+	filter := testEventFilter{eventFilter: eventFilter}
+
+	if testEventQuery.RunID != types.RunID(0) {
+		clauses = append(clauses, "run_id = :run_id")
+		filter.RunID = testEventQuery.RunID
+	}
+	if testEventQuery.TestName != "" {
+		clauses = append(clauses, "test_name = :test_name")
+		filter.TestName = testEventQuery.TestName
+	}
+	if testEventQuery.TestStepLabel != "" {
+		clauses = append(clauses, "test_step_label = :test_step_label")
+		filter.TestStepLabel = testEventQuery.TestStepLabel
+	}
+	return clauses, filter
+}
+
+func buildTestEventQuery(driver Driver, baseQuery string, testEventQuery *testevent.Query) (safesql.TrustedSQLString, []interface{}, error) {
+	if testEventQuery == nil {
+		return safesql.New(""), nil, fmt.Errorf("cannot build empty testevent query")
+	}
+	clauses, filter := testEventClauses(testEventQuery)
+	query, fields, err := assembleQuery(driver, baseQuery, clauses, "", filter)
+	if err != nil {
+		return safesql.New(""), nil, fmt.Errorf("could not assemble query for test events: %w", err)
+	}
+	return query, fields, nil
+}
@@ -0,0 +1,200 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"sync"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/event/frameworkevent"
+	"github.com/linuxboot/contest/pkg/event/testevent"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+)
+
+// defaultTestEventsFlushSize and defaultFrameworkEventsFlushSize are the
+// buffer sizes used when the corresponding option is not supplied to
+// NewRDBMS.
+const (
+	defaultTestEventsFlushSize      = 1000
+	defaultFrameworkEventsFlushSize = 1000
+
+	// defaultRunHistoryRetentionInterval is how often the retention
+	// goroutine checks for expired run_history rows, used when
+	// WithRunHistoryRetention is set without WithRunHistoryRetentionInterval.
+	defaultRunHistoryRetentionInterval = time.Hour
+)
+
+// RDBMS is a storage engine that buffers test and framework events in
+// memory and periodically flushes them to a SQL-compatible backend.
+type RDBMS struct {
+	db *safesql.DB
+
+	// driver abstracts the placeholder style and batching limits of the
+	// underlying SQL backend (MySQL, PostgreSQL or SQLite).
+	driver Driver
+
+	// listenerDSN, when set on a PostgreSQL-backed RDBMS, lets
+	// SubscribeTestEvents open its own lib/pq listener connection for
+	// LISTEN/NOTIFY instead of falling back to polling.
+	listenerDSN string
+
+	txLock sync.Mutex
+
+	testEventsLock      sync.Mutex
+	buffTestEvents      []testevent.Event
+	testEventsFlushSize int
+
+	frameworkEventsLock      sync.Mutex
+	buffFrameworkEvents      []frameworkevent.Event
+	frameworkEventsFlushSize int
+
+	runHistoryRetentionTTL      time.Duration
+	runHistoryRetentionInterval time.Duration
+	stopRetention               chan struct{}
+	retentionDone               chan struct{}
+
+	stmtCache *preparedStatementCache
+}
+
+// Option mutates an RDBMS instance at construction time.
+type Option func(*RDBMS)
+
+// WithDriver selects the SQL dialect used to build and batch statements.
+// When not supplied, NewRDBMS defaults to the MySQL driver, which matches
+// the placeholder style ContesT has historically shipped with.
+func WithDriver(driver Driver) Option {
+	return func(r *RDBMS) {
+		r.driver = driver
+	}
+}
+
+// WithTestEventsFlushSize overrides the number of buffered test events that
+// triggers an automatic flush.
+func WithTestEventsFlushSize(size int) Option {
+	return func(r *RDBMS) {
+		r.testEventsFlushSize = size
+	}
+}
+
+// WithFrameworkEventsFlushSize overrides the number of buffered framework
+// events that triggers an automatic flush.
+func WithFrameworkEventsFlushSize(size int) Option {
+	return func(r *RDBMS) {
+		r.frameworkEventsFlushSize = size
+	}
+}
+
+// WithRunHistoryRetention enables the background retention goroutine,
+// pruning run_history rows older than ttl on a periodic basis. Without this
+// option, run_history rows accumulate forever and callers are expected to
+// invoke PruneRunHistory themselves.
+func WithRunHistoryRetention(ttl time.Duration) Option {
+	return func(r *RDBMS) {
+		r.runHistoryRetentionTTL = ttl
+	}
+}
+
+// WithPostgresListenerDSN configures the connection string SubscribeTestEvents
+// uses to open a dedicated lib/pq LISTEN/NOTIFY connection. It only takes
+// effect when paired with WithDriver(PostgreSQLDriver{}); other drivers
+// always use the polling fallback.
+func WithPostgresListenerDSN(dsn string) Option {
+	return func(r *RDBMS) {
+		r.listenerDSN = dsn
+	}
+}
+
+// WithRunHistoryRetentionInterval overrides how often the retention
+// goroutine checks for expired run_history rows. Only takes effect when
+// combined with WithRunHistoryRetention.
+func WithRunHistoryRetentionInterval(interval time.Duration) Option {
+	return func(r *RDBMS) {
+		r.runHistoryRetentionInterval = interval
+	}
+}
+
+// WithStatementCacheSize overrides how many prepared statements RDBMS keeps
+// cached; see preparedStatementCache. A size of 0 disables the cache.
+func WithStatementCacheSize(size int) Option {
+	return func(r *RDBMS) {
+		r.stmtCache = newPreparedStatementCache(size)
+	}
+}
+
+// WithMaxOpenConns sets the maximum number of open connections to the
+// database, mirroring database/sql.DB.SetMaxOpenConns.
+func WithMaxOpenConns(n int) Option {
+	return func(r *RDBMS) {
+		r.db.SetMaxOpenConns(n)
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections kept in the
+// pool, mirroring database/sql.DB.SetMaxIdleConns.
+func WithMaxIdleConns(n int) Option {
+	return func(r *RDBMS) {
+		r.db.SetMaxIdleConns(n)
+	}
+}
+
+// WithConnMaxLifetime sets the maximum amount of time a connection may be
+// reused, mirroring database/sql.DB.SetConnMaxLifetime.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(r *RDBMS) {
+		r.db.SetConnMaxLifetime(d)
+	}
+}
+
+// NewRDBMS builds an RDBMS storage engine on top of an already-open
+// database handle. By default it assumes a MySQL-compatible backend; use
+// WithDriver to target PostgreSQL or SQLite instead.
+func NewRDBMS(db *safesql.DB, opts ...Option) (*RDBMS, error) {
+	r := &RDBMS{
+		db:                          db,
+		driver:                      MySQLDriver{},
+		testEventsFlushSize:         defaultTestEventsFlushSize,
+		frameworkEventsFlushSize:    defaultFrameworkEventsFlushSize,
+		runHistoryRetentionInterval: defaultRunHistoryRetentionInterval,
+		stmtCache:                   newPreparedStatementCache(defaultStatementCacheSize),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.runHistoryRetentionTTL > 0 {
+		r.stopRetention = make(chan struct{})
+		r.retentionDone = make(chan struct{})
+		go func() {
+			defer close(r.retentionDone)
+			r.runRetentionLoop(xcontext.Background(), r.runHistoryRetentionTTL, r.runHistoryRetentionInterval, r.stopRetention)
+		}()
+	}
+	return r, nil
+}
+
+// Close stops the background run_history retention goroutine, if one was
+// started via WithRunHistoryRetention. It is safe to call on an RDBMS that
+// never started one.
+func (r *RDBMS) Close() error {
+	if r.stopRetention != nil {
+		close(r.stopRetention)
+		<-r.retentionDone
+	}
+	return r.stmtCache.Close()
+}
+
+// lockTx serializes access to the underlying connection across the
+// goroutines that flush events and the ones that query them, so that a
+// flush and a read never interleave their statements.
+func (r *RDBMS) lockTx() {
+	r.txLock.Lock()
+}
+
+// unlockTx releases the lock acquired by lockTx.
+func (r *RDBMS) unlockTx() {
+	r.txLock.Unlock()
+}
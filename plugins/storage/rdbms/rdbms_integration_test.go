@@ -0,0 +1,245 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build integration
+
+package rdbms
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/event"
+	"github.com/linuxboot/contest/pkg/event/frameworkevent"
+	"github.com/linuxboot/contest/pkg/event/testevent"
+	"github.com/linuxboot/contest/pkg/target"
+	"github.com/linuxboot/contest/pkg/types"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// These tests exercise the batched multi-row INSERT path against a real
+// driver of each supported backend. SQLite runs in-process and needs no
+// setup; MySQL and PostgreSQL read their DSN from an environment variable
+// and skip if it isn't set. scripts/standup_mysql.sh and
+// scripts/standup_postgres.sh bring up a disposable instance of each and
+// print the export line CI (or a developer) needs before running:
+//
+//	go test -tags=integration ./plugins/storage/rdbms/...
+
+const (
+	mysqlDSNEnv    = "CONTEST_RDBMS_MYSQL_DSN"
+	postgresDSNEnv = "CONTEST_RDBMS_POSTGRES_DSN"
+)
+
+var schemaByDriver = map[string][]string{
+	"sqlite3": {
+		`create table test_events (
+			event_id integer primary key autoincrement,
+			job_id integer not null,
+			run_id integer not null,
+			test_name text not null,
+			test_attempt integer not null,
+			test_step_label text not null,
+			event_name text not null,
+			target_id text,
+			payload text,
+			emit_time timestamp not null
+		)`,
+		`create table framework_events (
+			event_id integer primary key autoincrement,
+			job_id integer not null,
+			event_name text not null,
+			payload text,
+			emit_time timestamp not null
+		)`,
+		`create table jobs (job_id integer primary key, state text not null)`,
+		`create table run_history (
+			job_id integer not null,
+			run_id integer not null,
+			test_name text not null,
+			target_id text,
+			start_time timestamp not null,
+			end_time timestamp,
+			final_state text,
+			final_status text,
+			primary key (job_id, run_id)
+		)`,
+	},
+	"mysql": {
+		`create table test_events (
+			event_id bigint primary key auto_increment,
+			job_id bigint not null,
+			run_id bigint not null,
+			test_name varchar(255) not null,
+			test_attempt int not null,
+			test_step_label varchar(255) not null,
+			event_name varchar(255) not null,
+			target_id varchar(255),
+			payload json,
+			emit_time timestamp(6) not null
+		)`,
+		`create table framework_events (
+			event_id bigint primary key auto_increment,
+			job_id bigint not null,
+			event_name varchar(255) not null,
+			payload json,
+			emit_time timestamp(6) not null
+		)`,
+		`create table jobs (job_id bigint primary key, state varchar(64) not null)`,
+		`create table run_history (
+			job_id bigint not null,
+			run_id bigint not null,
+			test_name varchar(255) not null,
+			target_id varchar(255),
+			start_time timestamp(6) not null,
+			end_time timestamp(6) null,
+			final_state varchar(64),
+			final_status json,
+			primary key (job_id, run_id)
+		)`,
+	},
+	"postgres": {
+		`create table test_events (
+			event_id bigserial primary key,
+			job_id bigint not null,
+			run_id bigint not null,
+			test_name text not null,
+			test_attempt int not null,
+			test_step_label text not null,
+			event_name text not null,
+			target_id text,
+			payload jsonb,
+			emit_time timestamp not null
+		)`,
+		`create table framework_events (
+			event_id bigserial primary key,
+			job_id bigint not null,
+			event_name text not null,
+			payload jsonb,
+			emit_time timestamp not null
+		)`,
+		`create table jobs (job_id bigint primary key, state text not null)`,
+		`create table run_history (
+			job_id bigint not null,
+			run_id bigint not null,
+			test_name text not null,
+			target_id text,
+			start_time timestamp not null,
+			end_time timestamp,
+			final_state text,
+			final_status jsonb,
+			primary key (job_id, run_id)
+		)`,
+	},
+}
+
+func TestBatchInsertSQLite(t *testing.T) {
+	// file::memory: with cache=shared keeps every pooled connection
+	// pointed at the same in-memory database; a plain ":memory:" DSN
+	// hands each pooled connection its own empty database.
+	testBatchInsertAgainstDriver(t, "sqlite3", "file::memory:?cache=shared", SQLiteDriver{})
+}
+
+func TestBatchInsertMySQL(t *testing.T) {
+	dsn := os.Getenv(mysqlDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set; run scripts/standup_mysql.sh and export it to run this test", mysqlDSNEnv)
+	}
+	testBatchInsertAgainstDriver(t, "mysql", dsn, MySQLDriver{})
+}
+
+func TestBatchInsertPostgres(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set; run scripts/standup_postgres.sh and export it to run this test", postgresDSNEnv)
+	}
+	testBatchInsertAgainstDriver(t, "postgres", dsn, PostgreSQLDriver{})
+}
+
+func testBatchInsertAgainstDriver(t *testing.T, driverName, dsn string, driver Driver) {
+	db, err := safesql.Open(driverName, dsn)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", driverName, err)
+	}
+	defer db.Close()
+
+	for _, table := range []string{"run_history", "framework_events", "test_events", "jobs"} {
+		_, _ = db.Exec(trustedDynamicSQL("drop table if exists " + table))
+	}
+	for _, stmt := range schemaByDriver[driverName] {
+		if _, err := db.Exec(trustedDynamicSQL(stmt)); err != nil {
+			t.Fatalf("could not create schema: %v", err)
+		}
+	}
+
+	r, err := NewRDBMS(&db, WithDriver(driver), WithTestEventsFlushSize(10))
+	if err != nil {
+		t.Fatalf("NewRDBMS: %v", err)
+	}
+	defer r.Close()
+
+	ctx := xcontext.Background()
+	const jobID = types.JobID(42)
+	const runID = types.RunID(1)
+
+	// Store more events than one flush batch, so several flushes run and
+	// the last one carries a partial batch.
+	const numEvents = 37
+	for i := 0; i < numEvents; i++ {
+		payload := json.RawMessage(`{"i":` + string(rune('0'+i%10)) + `}`)
+		ev := testevent.New(&testevent.Header{
+			JobID:         jobID,
+			RunID:         runID,
+			TestName:      "batch-insert-test",
+			TestAttempt:   1,
+			TestStepLabel: "step1",
+		}, &testevent.Data{
+			EventName: "TestStarted",
+			Target:    &target.Target{ID: "target-1"},
+			Payload:   &payload,
+		})
+		ev.EmitTime = time.Now()
+		if err := r.StoreTestEvent(ctx, ev); err != nil {
+			t.Fatalf("StoreTestEvent(%d): %v", i, err)
+		}
+	}
+	if err := r.flushTestEvents(); err != nil {
+		t.Fatalf("flushTestEvents: %v", err)
+	}
+
+	got, err := r.GetTestEvents(ctx, &testevent.Query{Query: event.Query{JobID: jobID}})
+	if err != nil {
+		t.Fatalf("GetTestEvents: %v", err)
+	}
+	if len(got) != numEvents {
+		t.Fatalf("got %d test events, want %d", len(got), numEvents)
+	}
+
+	history, err := r.GetRunHistory(ctx, RunHistoryQuery{JobID: jobID})
+	if err != nil {
+		t.Fatalf("GetRunHistory: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("got %d run_history rows, want 1", len(history))
+	}
+	if history[0].RunID != runID {
+		t.Fatalf("run_history row has run_id %d, want %d", history[0].RunID, runID)
+	}
+
+	if err := r.StoreFrameworkEvent(ctx, frameworkevent.Event{JobID: jobID, EventName: "JobStateCompleted", EmitTime: time.Now()}); err != nil {
+		t.Fatalf("StoreFrameworkEvent: %v", err)
+	}
+	if err := r.flushFrameworkEvents(); err != nil {
+		t.Fatalf("flushFrameworkEvents: %v", err)
+	}
+}
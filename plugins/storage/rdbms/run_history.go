@@ -0,0 +1,240 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/job"
+	"github.com/linuxboot/contest/pkg/types"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+)
+
+// runHistorySchema documents the table this subsystem expects to already
+// exist in the target database (created by the corresponding migration).
+// It materializes one row per (job_id, run_id), folded from the test and
+// framework events flushed for that run, so dashboards can answer
+// per-target questions without scanning the raw test_events table.
+//
+//	create table run_history (
+//		job_id        bigint not null,
+//		run_id        bigint not null,
+//		test_name     varchar(255) not null,
+//		target_id     varchar(255),
+//		start_time    timestamp not null,
+//		end_time      timestamp,
+//		final_state   varchar(64),
+//		final_status  json,
+//		primary key (job_id, run_id)
+//	);
+//	create index run_history_target_start_idx on run_history (target_id, start_time);
+const runHistorySchema = ""
+
+// RunHistory is a per-run summary materialized at event-flush time from
+// the test and framework events belonging to a single (job_id, run_id).
+type RunHistory struct {
+	JobID       types.JobID
+	RunID       types.RunID
+	TestName    string
+	TargetID    string
+	StartTime   time.Time
+	EndTime     *time.Time
+	FinalState  string
+	FinalStatus *json.RawMessage
+}
+
+// RunHistoryQuery selects which run_history rows GetRunHistory returns.
+type RunHistoryQuery struct {
+	TargetID        string
+	JobID           types.JobID
+	StartTimeAfter  time.Time
+	StartTimeBefore time.Time
+}
+
+const insertRunHistoryStartPrefix = "insert into run_history (job_id, run_id, test_name, target_id, start_time) values (?, ?, ?, ?, ?)"
+
+// updateRunHistoryFinalStmt closes out the most recently started run_history
+// row that is still open for a job. frameworkevent.Event carries no run_id
+// of its own (job-state transitions are job-scoped, not run-scoped), and a
+// job can in principle have more than one open run_history row if a prior
+// run was never closed out (crash, missed completion event, ...); scoping
+// by job_id alone would stamp every open row for that job with this
+// transition's end_time/final_state/final_status, corrupting the stale
+// run's history. The nested select picks the single most-recently-started
+// open run for the job, so only that row is closed. It is wrapped in a
+// derived table because MySQL rejects an update whose subquery reads the
+// table being updated directly.
+const updateRunHistoryFinalStmt = `update run_history set end_time = ?, final_state = ?, final_status = ?
+	where job_id = ? and end_time is null and run_id = (
+		select run_id from (
+			select run_id from run_history where job_id = ? and end_time is null order by run_id desc limit 1
+		) as latest_open_run
+	)`
+
+// foldTestEventRunHistoryLocked records the earliest (job_id, run_id) a
+// buffered test event was seen in as the start of a run_history row. It is
+// a no-op for runs that already have a row, so it only ever captures the
+// first test event of a run.
+func (r *RDBMS) foldTestEventRunHistoryLocked(tx safesql.Tx, rows [][]interface{}) error {
+	insertStatement := trustedDynamicSQL(r.driver.Rebind(insertRunHistoryStartPrefix + r.driver.InsertIgnoreSuffix("job_id, run_id")))
+	return r.withPreparedStatement(insertStatement, func(stmt *sql.Stmt) error {
+		txStmt := tx.Stmt(stmt)
+		seen := map[[2]interface{}]bool{}
+		for _, row := range rows {
+			jobID, runID, testName, _, _, _, targetID, _, emitTime := row[0], row[1], row[2], row[3], row[4], row[5], row[6], row[7], row[8]
+			key := [2]interface{}{jobID, runID}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, err := txStmt.Exec(jobID, runID, testName, targetID, emitTime); err != nil {
+				return fmt.Errorf("could not record run history start: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// foldFrameworkEventRunHistoryLocked closes out the most recently started
+// open run_history row of every job whose state transitioned during this
+// flush (see updateRunHistoryFinalStmt), recording the final state, the
+// payload of the job's last state-transition event as final_status, and
+// the time of that transition as end_time.
+func (r *RDBMS) foldFrameworkEventRunHistoryLocked(tx safesql.Tx, jobStateUpdates map[types.JobID]job.State, jobEndTime map[types.JobID]time.Time, jobPayload map[types.JobID]*json.RawMessage) error {
+	return r.withPreparedStatement(trustedDynamicSQL(r.driver.Rebind(updateRunHistoryFinalStmt)), func(stmt *sql.Stmt) error {
+		txStmt := tx.Stmt(stmt)
+		for jobID, state := range jobStateUpdates {
+			if _, err := txStmt.Exec(jobEndTime[jobID], state, jobPayload[jobID], jobID, jobID); err != nil {
+				return fmt.Errorf("could not close out run history for job %d: %w", jobID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// GetRunHistory retrieves the run_history rows matching historyQuery.
+func (r *RDBMS) GetRunHistory(ctx xcontext.Context, historyQuery RunHistoryQuery) ([]RunHistory, error) {
+	r.lockTx()
+	defer r.unlockTx()
+
+	clauses := []string{}
+	var filter runHistoryFilter
+	if historyQuery.JobID != 0 {
+		clauses = append(clauses, "job_id = :job_id")
+		filter.JobID = historyQuery.JobID
+	}
+	if historyQuery.TargetID != "" {
+		clauses = append(clauses, "target_id = :target_id")
+		filter.TargetID = historyQuery.TargetID
+	}
+	if !historyQuery.StartTimeAfter.IsZero() {
+		clauses = append(clauses, "start_time >= :start_time_after")
+		filter.StartTimeAfter = historyQuery.StartTimeAfter
+	}
+	if !historyQuery.StartTimeBefore.IsZero() {
+		clauses = append(clauses, "start_time <= :start_time_before")
+		filter.StartTimeBefore = historyQuery.StartTimeBefore
+	}
+
+	const baseQuery = "select job_id, run_id, test_name, target_id, start_time, end_time, final_state, final_status from run_history"
+	var (
+		query  safesql.TrustedSQLString
+		fields []interface{}
+		err    error
+	)
+	if len(clauses) == 0 {
+		query = safesql.New(baseQuery)
+	} else {
+		query, fields, err = assembleQuery(r.driver, baseQuery, clauses, "", filter)
+		if err != nil {
+			return nil, fmt.Errorf("could not assemble run history query: %w", err)
+		}
+	}
+
+	// Not cached: see preparedStatementCache's doc comment.
+	ctx.Debugf("Executing query: %s, fields: %v", query, fields)
+	rows, err := r.db.Query(query, fields...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			ctx.Warnf("could not close rows for run history: %v", err)
+		}
+	}()
+
+	var results []RunHistory
+	for rows.Next() {
+		var (
+			rh          RunHistory
+			targetID    sql.NullString
+			endTime     sql.NullTime
+			finalState  sql.NullString
+			finalStatus sql.NullString
+		)
+		if err := rows.Scan(&rh.JobID, &rh.RunID, &rh.TestName, &targetID, &rh.StartTime, &endTime, &finalState, &finalStatus); err != nil {
+			return nil, fmt.Errorf("could not read run history results from db: %w", err)
+		}
+		rh.TargetID = targetID.String
+		if endTime.Valid {
+			rh.EndTime = &endTime.Time
+		}
+		rh.FinalState = finalState.String
+		if finalStatus.Valid {
+			rawStatus := json.RawMessage(finalStatus.String)
+			rh.FinalStatus = &rawStatus
+		}
+		results = append(results, rh)
+	}
+	return results, nil
+}
+
+// PruneRunHistory deletes run_history rows whose start_time is older than
+// olderThan, returning the number of rows removed.
+func (r *RDBMS) PruneRunHistory(ctx xcontext.Context, olderThan time.Time) (int64, error) {
+	r.lockTx()
+	defer r.unlockTx()
+
+	res, err := r.db.Exec(trustedDynamicSQL(r.driver.Rebind("delete from run_history where start_time < ?")), olderThan)
+	if err != nil {
+		return 0, fmt.Errorf("could not prune run history: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// runHistoryFilter mirrors RunHistoryQuery as named-parameter fields for
+// assembleQuery.
+type runHistoryFilter struct {
+	JobID           types.JobID `db:"job_id"`
+	TargetID        string      `db:"target_id"`
+	StartTimeAfter  time.Time   `db:"start_time_after"`
+	StartTimeBefore time.Time   `db:"start_time_before"`
+}
+
+// runRetentionLoop periodically prunes run_history rows older than the
+// configured TTL, so long-running deployments don't have to grow the table
+// unbounded. It exits once stopCh is closed.
+func (r *RDBMS) runRetentionLoop(ctx xcontext.Context, ttl time.Duration, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if n, err := r.PruneRunHistory(ctx, time.Now().Add(-ttl)); err != nil {
+				ctx.Warnf("run history retention: prune failed: %v", err)
+			} else if n > 0 {
+				ctx.Debugf("run history retention: pruned %d rows older than %s", n, ttl)
+			}
+		}
+	}
+}
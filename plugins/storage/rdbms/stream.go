@@ -0,0 +1,132 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"fmt"
+
+	"github.com/linuxboot/contest/pkg/event/testevent"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+)
+
+const testEventsBaseQuery = "select event_id, job_id, run_id, test_name, test_attempt, test_step_label, event_name, target_id, payload, emit_time from test_events"
+
+// buildTestEventQueryPage extends testEventClauses with a keyset-pagination
+// predicate (`event_id > :after_event_id`) and an `order by event_id asc limit
+// :limit` tail, so pagination composes with the filters buildTestEventQuery
+// already supports instead of requiring its own query path.
+func buildTestEventQueryPage(driver Driver, baseQuery string, testEventQuery *testevent.Query, afterEventID int64, limit int) (safesql.TrustedSQLString, []interface{}, error) {
+	if testEventQuery == nil {
+		return safesql.New(""), nil, fmt.Errorf("cannot build empty testevent query")
+	}
+	clauses, filter := testEventClauses(testEventQuery)
+	clauses = append(clauses, "event_id > :after_event_id")
+
+	type pagedFilter struct {
+		testEventFilter
+		AfterEventID int64 `db:"after_event_id"`
+		Limit        int   `db:"limit"`
+	}
+	pf := pagedFilter{testEventFilter: filter, AfterEventID: afterEventID, Limit: limit}
+
+	query, fields, err := assembleQuery(driver, baseQuery, clauses, " order by event_id asc limit :limit", pf)
+	if err != nil {
+		return safesql.New(""), nil, fmt.Errorf("could not assemble paginated query for test events: %w", err)
+	}
+	return query, fields, nil
+}
+
+// StreamTestEvents runs the given query and invokes fn once per matching
+// row, instead of accumulating the whole result set in memory like
+// GetTestEvents does. It stops and returns fn's error as soon as fn returns
+// one.
+func (r *RDBMS) StreamTestEvents(ctx xcontext.Context, eventQuery *testevent.Query, fn func(testevent.Event) error) error {
+	if err := r.flushTestEvents(); err != nil {
+		return fmt.Errorf("could not flush events before streaming events: %v", err)
+	}
+
+	r.lockTx()
+	defer r.unlockTx()
+
+	query, fields, err := buildTestEventQuery(r.driver, testEventsBaseQuery, eventQuery)
+	if err != nil {
+		return fmt.Errorf("could not build select query for test events: %v", err)
+	}
+
+	// Not cached: see preparedStatementCache's doc comment.
+	ctx.Debugf("Executing query: %s, fields: %v", query, fields)
+	rows, err := r.db.Query(query, fields...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			ctx.Warnf("could not close rows for test events: %v", err)
+		}
+	}()
+
+	for rows.Next() {
+		event, _, err := scanTestEventRow(rows)
+		if err != nil {
+			return err
+		}
+		rowsScannedTotal.Inc()
+		bytesReturnedTotal.Add(float64(eventSize(event)))
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetTestEventsPage retrieves up to limit test events matching eventQuery
+// whose event_id is greater than afterEventID, ordered by event_id, so
+// callers can page through a large result set instead of loading it all at
+// once. Pass afterEventID 0 to start from the beginning. It also returns the
+// event_id of the last row in the page (afterEventID unchanged if the page
+// is empty), which the caller passes back as afterEventID on the next call
+// to advance the cursor.
+func (r *RDBMS) GetTestEventsPage(ctx xcontext.Context, eventQuery *testevent.Query, afterEventID int64, limit int) ([]testevent.Event, int64, error) {
+	if err := r.flushTestEvents(); err != nil {
+		return nil, afterEventID, fmt.Errorf("could not flush events before reading events: %v", err)
+	}
+
+	r.lockTx()
+	defer r.unlockTx()
+
+	query, fields, err := buildTestEventQueryPage(r.driver, testEventsBaseQuery, eventQuery, afterEventID, limit)
+	if err != nil {
+		return nil, afterEventID, fmt.Errorf("could not build paginated select query for test events: %v", err)
+	}
+
+	// Not cached: see preparedStatementCache's doc comment.
+	ctx.Debugf("Executing query: %s, fields: %v", query, fields)
+	rows, err := r.db.Query(query, fields...)
+	if err != nil {
+		return nil, afterEventID, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			ctx.Warnf("could not close rows for test events: %v", err)
+		}
+	}()
+
+	lastEventID := afterEventID
+	var results []testevent.Event
+	for rows.Next() {
+		event, eventID, err := scanTestEventRow(rows)
+		if err != nil {
+			return nil, afterEventID, err
+		}
+		rowsScannedTotal.Inc()
+		bytesReturnedTotal.Add(float64(eventSize(event)))
+		results = append(results, event)
+		lastEventID = eventID
+	}
+	return results, lastEventID, rows.Err()
+}
@@ -0,0 +1,287 @@
+// Copyright (c) Facebook, Inc. and its affiliates.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package rdbms
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/linuxboot/contest/pkg/event/testevent"
+	"github.com/linuxboot/contest/pkg/xcontext"
+
+	"github.com/google/go-safeweb/safesql"
+	"github.com/lib/pq"
+)
+
+// subscribeChannel is the Postgres NOTIFY channel the `test_events` insert
+// trigger publishes to; see newEventsNotifyTrigger below for the DDL this
+// assumes has already been applied at migration time.
+const subscribeChannel = "contest_test_events"
+
+// newEventsNotifyTrigger documents the trigger this package expects a
+// PostgreSQL-backed deployment to have installed, so every test_events
+// insert fires a NOTIFY subscribers can LISTEN for.
+//
+//	create or replace function contest_notify_test_event() returns trigger as $$
+//	begin
+//		perform pg_notify('contest_test_events', new.event_id::text);
+//		return new;
+//	end;
+//	$$ language plpgsql;
+//	create trigger contest_test_events_notify after insert on test_events
+//		for each row execute function contest_notify_test_event();
+const newEventsNotifyTrigger = ""
+
+const (
+	// subscriptionBufferSize is how many unread events a subscription
+	// channel holds before SubscribeTestEvents starts dropping events.
+	subscriptionBufferSize = 256
+	// pollFallbackInterval is how often the non-Postgres subscription
+	// fallback checks for new events.
+	pollFallbackInterval = 2 * time.Second
+	// pollFallbackPageSize bounds how many events the poller fetches per
+	// query; within one tick it keeps fetching pages until one comes back
+	// short of this size.
+	pollFallbackPageSize = 256
+
+	listenerMinReconnectInterval = 10 * time.Second
+	listenerMaxReconnectInterval = time.Minute
+)
+
+// SubscribeTestEvents returns a channel that receives test events matching
+// eventQuery as they are stored, so consumers (job manager, UI, external
+// plugins) can react to new events without polling GetTestEvents in a
+// loop. Under PostgreSQL this is backed by LISTEN/NOTIFY; other backends
+// fall back to a poller that tails `event_id > lastSeen` on
+// pollFallbackInterval.
+//
+// The returned channel is closed once ctx is done. If a subscriber falls
+// behind and the channel's buffer fills up, new events are dropped (and a
+// warning logged) rather than blocking storage.
+func (r *RDBMS) SubscribeTestEvents(ctx xcontext.Context, eventQuery *testevent.Query) (<-chan testevent.Event, error) {
+	ch := make(chan testevent.Event, subscriptionBufferSize)
+
+	if _, ok := r.driver.(PostgreSQLDriver); ok && r.listenerDSN != "" {
+		listener := pq.NewListener(r.listenerDSN, listenerMinReconnectInterval, listenerMaxReconnectInterval, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				ctx.Warnf("test event subscription: listener event: %v", err)
+			}
+		})
+		if err := listener.Listen(subscribeChannel); err != nil {
+			return nil, fmt.Errorf("could not listen on %s: %w", subscribeChannel, err)
+		}
+		go r.pgSubscriptionLoop(ctx, listener, eventQuery, ch)
+		return ch, nil
+	}
+
+	// Start the poller from the latest event_id already stored, not from
+	// the beginning of the table: this is a subscription to new events, not
+	// a replay of history, and test_events can already hold a large backlog
+	// by the time a subscriber shows up.
+	lastSeen, err := r.currentMaxTestEventID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine starting point for test event subscription: %w", err)
+	}
+	go r.pollSubscriptionLoop(ctx, eventQuery, ch, lastSeen)
+	return ch, nil
+}
+
+const maxTestEventIDQuery = "select coalesce(max(event_id), 0) from test_events"
+
+// currentMaxTestEventID returns the highest event_id currently stored in
+// test_events (0 if the table is empty), so a new subscription's poller
+// knows to tail from here instead of from the start of the table.
+func (r *RDBMS) currentMaxTestEventID(ctx xcontext.Context) (int64, error) {
+	if err := r.flushTestEvents(); err != nil {
+		return 0, fmt.Errorf("could not flush events before subscribing: %w", err)
+	}
+
+	r.lockTx()
+	defer r.unlockTx()
+
+	var maxID int64
+	if err := r.db.QueryRow(safesql.New(maxTestEventIDQuery)).Scan(&maxID); err != nil {
+		return 0, fmt.Errorf("could not read max event id: %w", err)
+	}
+	return maxID, nil
+}
+
+// pgSubscriptionLoop relays NOTIFY payloads (a bare event_id) on listener
+// into matching testevent.Events on ch, re-running eventQuery's filters
+// server-side so subscribers never see events outside their subscription.
+func (r *RDBMS) pgSubscriptionLoop(ctx xcontext.Context, listener *pq.Listener, eventQuery *testevent.Query, ch chan<- testevent.Event) {
+	defer close(ch)
+	defer func() {
+		if err := listener.Close(); err != nil {
+			ctx.Warnf("test event subscription: could not close listener: %v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// nil notification after a reconnect: nothing to relay.
+				continue
+			}
+			eventID, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				ctx.Warnf("test event subscription: could not parse notified event id %q: %v", n.Extra, err)
+				continue
+			}
+			event, found, err := r.fetchMatchingTestEvent(ctx, eventQuery, eventID)
+			if err != nil {
+				ctx.Warnf("test event subscription: could not fetch event %d: %v", eventID, err)
+				continue
+			}
+			if !found {
+				continue
+			}
+			r.deliver(ctx, ch, event)
+		}
+	}
+}
+
+// pollSubscriptionLoop is the change-data-poller fallback used for drivers
+// without a LISTEN/NOTIFY equivalent (MySQL, SQLite, or Postgres without a
+// configured listener DSN). It tails event_id > lastSeen on
+// pollFallbackInterval, starting from the lastSeen the caller observed at
+// subscription time so it never replays events older than the
+// subscription itself.
+func (r *RDBMS) pollSubscriptionLoop(ctx xcontext.Context, eventQuery *testevent.Query, ch chan<- testevent.Event, lastSeen int64) {
+	defer close(ch)
+
+	ticker := time.NewTicker(pollFallbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				events, lastID, err := r.pollTestEventsPage(ctx, eventQuery, lastSeen)
+				if err != nil {
+					ctx.Warnf("test event subscription: poll failed: %v", err)
+					break
+				}
+				for _, event := range events {
+					r.deliver(ctx, ch, event)
+				}
+				if len(events) == 0 {
+					break
+				}
+				lastSeen = lastID
+				if len(events) < pollFallbackPageSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// pollTestEventsPage is GetTestEventsPage with the page size fixed at
+// pollFallbackPageSize and without updating the rows-scanned and
+// bytes-returned counters. Like GetTestEventsPage it returns the last
+// event_id observed in the page, so pollSubscriptionLoop can keep draining
+// a burst of inserts without re-querying from the start each time.
+func (r *RDBMS) pollTestEventsPage(ctx xcontext.Context, eventQuery *testevent.Query, afterEventID int64) ([]testevent.Event, int64, error) {
+	r.testEventsLock.Lock()
+	if err := r.flushTestEventsLocked(); err != nil {
+		r.testEventsLock.Unlock()
+		return nil, afterEventID, fmt.Errorf("could not flush events before polling: %w", err)
+	}
+	r.testEventsLock.Unlock()
+
+	r.lockTx()
+	defer r.unlockTx()
+
+	query, fields, err := buildTestEventQueryPage(r.driver, testEventsBaseQuery, eventQuery, afterEventID, pollFallbackPageSize)
+	if err != nil {
+		return nil, afterEventID, err
+	}
+	// Not cached: see preparedStatementCache's doc comment.
+	rows, err := r.db.Query(query, fields...)
+	if err != nil {
+		return nil, afterEventID, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			ctx.Warnf("could not close rows while polling test events: %v", err)
+		}
+	}()
+
+	lastID := afterEventID
+	var events []testevent.Event
+	for rows.Next() {
+		event, eventID, err := scanTestEventRow(rows)
+		if err != nil {
+			return nil, afterEventID, err
+		}
+		events = append(events, event)
+		lastID = eventID
+	}
+	return events, lastID, rows.Err()
+}
+
+// fetchMatchingTestEvent fetches the single test event with the given
+// event_id if, and only if, it also satisfies eventQuery's filters.
+func (r *RDBMS) fetchMatchingTestEvent(ctx xcontext.Context, eventQuery *testevent.Query, eventID int64) (testevent.Event, bool, error) {
+	if eventQuery == nil {
+		return testevent.Event{}, false, fmt.Errorf("cannot fetch notified test event for a nil query")
+	}
+
+	r.lockTx()
+	defer r.unlockTx()
+
+	clauses, filter := testEventClauses(eventQuery)
+	clauses = append(clauses, "event_id = :notified_event_id")
+
+	type notifiedFilter struct {
+		testEventFilter
+		NotifiedEventID int64 `db:"notified_event_id"`
+	}
+	nf := notifiedFilter{testEventFilter: filter, NotifiedEventID: eventID}
+
+	query, fields, err := assembleQuery(r.driver, testEventsBaseQuery, clauses, "", nf)
+	if err != nil {
+		return testevent.Event{}, false, err
+	}
+	// Not cached: see preparedStatementCache's doc comment.
+	rows, err := r.db.Query(query, fields...)
+	if err != nil {
+		return testevent.Event{}, false, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			ctx.Warnf("could not close rows while fetching notified test event: %v", err)
+		}
+	}()
+	if !rows.Next() {
+		return testevent.Event{}, false, rows.Err()
+	}
+	event, _, err := scanTestEventRow(rows)
+	if err != nil {
+		return testevent.Event{}, false, err
+	}
+	return event, true, nil
+}
+
+// deliver sends event on ch, dropping it with a warning instead of
+// blocking if the subscriber has fallen behind and the channel is full.
+func (r *RDBMS) deliver(ctx xcontext.Context, ch chan<- testevent.Event, event testevent.Event) {
+	select {
+	case ch <- event:
+	default:
+		ctx.Warnf("test event subscription: channel buffer full, dropping event for job %v", TestEventJobID(event))
+	}
+}